@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cozodb/cozo-lib-go"
+)
+
+// cozoTxMu serializes cozotx-using requests: see TemplateHandler, which
+// holds it for the duration of a request that calls cozotx, since its
+// rollback restores a whole-database snapshot and two such rollbacks
+// running concurrently could revert each other's writes.
+var cozoTxMu sync.Mutex
+
+// CozoRun executes a single Cozo Datalog script against db with named
+// params (build params with the dict template func, e.g.
+// dict "id" .Form.id) and returns the result rows as []map[string]any,
+// matching the shape QueryRows returns for SQL.
+func CozoRun(db cozo.CozoDB, script string, params map[string]any) ([]map[string]any, error) {
+	result, err := db.Run(script, cozo.Map(params))
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]map[string]any, len(result.Rows))
+	for i, row := range result.Rows {
+		m := make(map[string]any, len(result.Headers))
+		for j, header := range result.Headers {
+			if j < len(row) {
+				m[header] = row[j]
+			}
+		}
+		rows[i] = m
+	}
+	return rows, nil
+}
+
+// CozoTx joins scripts into a single Cozo script, separated by ";\n", and
+// runs them in one Run call so they apply as a single transaction: Cozo
+// guarantees a Run call's effects are all-or-nothing, so a failing
+// statement rolls back every statement in the batch, not just itself.
+// See TemplateHandler for the additional rollback wired into the
+// request's overall template execution, since the driver has no
+// interactive BEGIN/ROLLBACK beyond one Run call.
+func CozoTx(db cozo.CozoDB, scripts []string) ([]map[string]any, error) {
+	if len(scripts) == 0 {
+		return nil, nil
+	}
+	rows, err := CozoRun(db, strings.Join(scripts, ";\n"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cozotx: %w", err)
+	}
+	return rows, nil
+}
+
+// backupCozo snapshots db to a fresh temp file and returns its path, so a
+// cozotx commit can be rolled back by restoring it if the request's
+// template execution later fails.
+func backupCozo(db cozo.CozoDB) (string, error) {
+	f, err := os.CreateTemp("", "cozotx-*.backup")
+	if err != nil {
+		return "", err
+	}
+	backupPath := f.Name()
+	f.Close()
+	os.Remove(backupPath) // Backup must create the file itself
+	if err := db.Backup(backupPath); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
+
+// CozoMigrate runs every *.cozo script found under dir in fsys, in
+// filename order. Relation/schema-creating scripts are expected to be
+// idempotent (e.g. using `:create` guarded by the relation not already
+// existing, or `:replace`), so this is safe to call on every handler
+// construction.
+func CozoMigrate(db cozo.CozoDB, fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.cozo"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		script, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Run(string(script), nil); err != nil {
+			return fmt.Errorf("migrate %s: %w", file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DirProvider discovers RouteGroups from a directory on disk: each
+// immediate subdirectory becomes a route group prefixed by its name (e.g.
+// routes/blog/*.html -> RouteGroup{Prefix: "/blog/", ...}). The directory
+// is watched via fsnotify so adding or removing a subdirectory produces a
+// fresh update without restarting the process. The subdirectories
+// themselves are not watched: adding, removing, or editing a file inside
+// an existing subdirectory produces no update until the next change to the
+// top-level directory triggers a rescan. Route groups
+// discovered this way don't share the main templates/ tree's _*.html
+// layout files, since they come from a separate filesystem root.
+type DirProvider struct {
+	dir      string
+	debounce time.Duration
+}
+
+// NewDirProvider returns a DirProvider watching dir, which must already
+// exist.
+func NewDirProvider(dir string) (*DirProvider, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return &DirProvider{dir: dir, debounce: 200 * time.Millisecond}, nil
+}
+
+func (p *DirProvider) Watch(ctx context.Context) (<-chan RouteGroup, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(p.dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	out := make(chan RouteGroup)
+	go func() {
+		defer w.Close()
+		defer close(out)
+
+		seen := make(map[string]bool)
+		p.scan(ctx, out, seen)
+
+		t := time.NewTimer(p.debounce)
+		if !t.Stop() {
+			<-t.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				t.Reset(p.debounce)
+			case <-t.C:
+				p.scan(ctx, out, seen)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// scan re-reads the top-level subdirectories of p.dir and emits one
+// RouteGroup per subdirectory that contains at least one *.html file. For
+// any prefix a previous scan emitted that isn't found this time (the
+// subdirectory was deleted, or emptied of *.html files), it emits a
+// tombstone RouteGroup so Manager stops serving it. seen holds the
+// prefixes emitted by the last scan and is updated in place for the next
+// one.
+func (p *DirProvider) scan(ctx context.Context, out chan<- RouteGroup, seen map[string]bool) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	found := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sub := filepath.Join(p.dir, e.Name())
+		matches, err := filepath.Glob(filepath.Join(sub, "*.html"))
+		if err != nil || len(matches) == 0 {
+			continue
+		}
+		files := make([]string, len(matches))
+		for i, m := range matches {
+			files[i] = filepath.Base(m)
+		}
+		prefix := "/" + e.Name() + "/"
+		found[prefix] = true
+		group := RouteGroup{
+			Prefix:    prefix,
+			FS:        os.DirFS(sub),
+			Templates: files,
+		}
+		select {
+		case out <- group:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for prefix := range seen {
+		if found[prefix] {
+			continue
+		}
+		select {
+		case out <- RouteGroup{Prefix: prefix, Removed: true}:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for prefix := range seen {
+		delete(seen, prefix)
+	}
+	for prefix := range found {
+		seen[prefix] = true
+	}
+}
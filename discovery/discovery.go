@@ -0,0 +1,130 @@
+// Package discovery lets a running handler pick up template-backed routes
+// from sources other than the on-disk templates/ tree without a restart,
+// modeled loosely on Prometheus's service-discovery target providers: each
+// Provider streams RouteGroup updates over a channel, and a Manager merges
+// updates from every configured provider and atomically swaps the active
+// *http.ServeMux.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// RouteGroup is a set of routes backed by the same template files and
+// funcs, registered under a single mux pattern (e.g. "/todos/"). FS is the
+// filesystem Templates are parsed from, so each Provider can supply its
+// own (the embedded/on-disk templates/ tree, a directory it's watching,
+// a remote bundle extracted to a temp dir, ...).
+type RouteGroup struct {
+	Prefix    string
+	FS        fs.FS
+	Templates []string
+	Funcs     template.FuncMap
+	// Removed marks this Prefix as no longer served by the Provider that
+	// sent it (e.g. its backing directory was deleted); FS/Templates/Funcs
+	// are ignored. A Provider that can remove groups it previously sent
+	// must send a tombstone, or Manager has no way to stop serving it.
+	Removed bool
+}
+
+// Provider streams RouteGroup updates until ctx is done, then closes the
+// returned channel. A static source (a config file, an initial disk scan)
+// sends its groups once and closes; a dynamic source (Consul KV, a
+// watched directory) keeps the channel open and sends again whenever its
+// routes change.
+type Provider interface {
+	Watch(ctx context.Context) (<-chan RouteGroup, error)
+}
+
+// Builder turns a RouteGroup into a routable http.Handler. It's supplied
+// by the caller rather than implemented here, since only the caller knows
+// how to parse and wire templates (avoiding an import cycle back to
+// package main).
+type Builder func(RouteGroup) (http.Handler, error)
+
+// Manager merges RouteGroup updates from any number of Providers into a
+// single routing table and atomically swaps the active *http.ServeMux as
+// updates arrive, so in-flight requests always see a consistent mux.
+type Manager struct {
+	build Builder
+
+	mu     sync.Mutex
+	groups map[string]RouteGroup
+	mux    atomic.Pointer[http.ServeMux]
+}
+
+func NewManager(build Builder) *Manager {
+	return &Manager{build: build, groups: make(map[string]RouteGroup)}
+}
+
+// Apply merges groups into the routing table and rebuilds the mux
+// synchronously. Use it for an initial, known-at-construction-time batch
+// (e.g. the routes already discovered from templates/) before handing the
+// Manager off to serve requests.
+func (m *Manager) Apply(groups []RouteGroup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range groups {
+		m.groups[g.Prefix] = g
+	}
+	return m.rebuild()
+}
+
+// Watch starts each provider in its own goroutine and merges its updates
+// into the routing table in the background until ctx is done. Errors
+// starting a provider or rebuilding the mux are logged rather than
+// returned, since Watch itself doesn't block.
+func (m *Manager) Watch(ctx context.Context, providers ...Provider) {
+	for _, p := range providers {
+		ch, err := p.Watch(ctx)
+		if err != nil {
+			log.Printf("discovery: starting provider: %v", err)
+			continue
+		}
+		go func(ch <-chan RouteGroup) {
+			for g := range ch {
+				m.mu.Lock()
+				if g.Removed {
+					delete(m.groups, g.Prefix)
+				} else {
+					m.groups[g.Prefix] = g
+				}
+				err := m.rebuild()
+				m.mu.Unlock()
+				if err != nil {
+					log.Printf("discovery: %s: %v", g.Prefix, err)
+				}
+			}
+		}(ch)
+	}
+}
+
+// rebuild must be called with m.mu held.
+func (m *Manager) rebuild() error {
+	mux := http.NewServeMux()
+	for _, g := range m.groups {
+		h, err := m.build(g)
+		if err != nil {
+			return fmt.Errorf("building route %s: %w", g.Prefix, err)
+		}
+		mux.Handle(g.Prefix, h)
+	}
+	m.mux.Store(mux)
+	return nil
+}
+
+// ServeHTTP dispatches to the most recently built mux.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if mux := m.mux.Load(); mux != nil {
+		mux.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -7,11 +7,16 @@ import (
 	"html/template"
 	"reflect"
 
+	"github.com/cozodb/cozo-lib-go"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
 
-func NewFuncs(db *sqlx.DB) template.FuncMap {
+// NewFuncs builds the template FuncMap shared by every page: SQL helpers
+// over db, and Cozo Datalog helpers over cdb (the driver actually wired
+// up in NewHandler). cozotx isn't here: it needs per-request rollback
+// state, so TemplateHandler binds it itself; see there.
+func NewFuncs(db *sqlx.DB, cdb cozo.CozoDB) template.FuncMap {
 	return template.FuncMap{
 		"exec": func(query string, params ...any) (sql.Result, error) {
 			return Exec(db, query, params...)
@@ -25,6 +30,13 @@ func NewFuncs(db *sqlx.DB) template.FuncMap {
 		"queryval": func(query string, params ...any) (val any, err error) {
 			return QueryVal(db, query, params...)
 		},
+		"cozo": func(script string, params map[string]any) ([]map[string]any, error) {
+			return CozoRun(cdb, script, params)
+		},
+		"cozorun": func(script string, params map[string]any) (err error) {
+			_, err = CozoRun(cdb, script, params)
+			return
+		},
 		"idx":  Idx,
 		"dict": Dict,
 		"list": List,
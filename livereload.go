@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// liveReloadHub broadcasts a "reload" event to every connected browser over
+// Server-Sent Events, so the client snippet in static/livereload.js can
+// refresh the page after the watcher rebuilds the handler. It is only
+// wired up when AreFilesEmbedded is false, since embedded builds have
+// nothing to watch.
+type liveReloadHub struct {
+	mu      sync.Mutex
+	clients map[chan string]struct{}
+}
+
+func newLiveReloadHub() *liveReloadHub {
+	return &liveReloadHub{clients: make(map[chan string]struct{})}
+}
+
+// Broadcast sends msg to every currently connected client, dropping it for
+// any client that isn't ready to receive so a slow browser can't stall a
+// reload notification for the rest.
+func (h *liveReloadHub) Broadcast(msg string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// ServeHTTP implements the /_livereload SSE endpoint: it registers a
+// client channel for the lifetime of the request and streams whatever
+// Broadcast sends until the browser disconnects.
+func (h *liveReloadHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan string, 1)
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.clients, ch)
+		h.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case msg := <-ch:
+			if _, err := w.Write([]byte("data: " + msg + "\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
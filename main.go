@@ -2,32 +2,54 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/cozodb/cozo-lib-go"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/exp/maps"
+
+	"go-htmx/discovery"
 )
 
 var config = struct {
-	ShutdownDelayTolerance time.Duration
-	ReloadDebounceDelay    time.Duration
+	ShutdownDrainDeadline time.Duration // time graceful shutdown grants in-flight requests to finish
+	ShutdownHardCap       time.Duration // hard cap after which remaining connections are force-closed
+	ReloadDebounceDelay   time.Duration
 }{
-	ShutdownDelayTolerance: 5 * time.Second,
-	ReloadDebounceDelay:    100 * time.Millisecond,
+	ShutdownDrainDeadline: 5 * time.Second,
+	ShutdownHardCap:       10 * time.Second,
+	ReloadDebounceDelay:   100 * time.Millisecond,
 }
 
+// liveReload broadcasts reload events to connected browsers; see
+// livereload.go. It's a package-level hub (rather than per-handler state)
+// so that it keeps its connected clients across the NewHandler rebuilds
+// that happen on every reload cycle.
+var liveReload = newLiveReloadHub()
+
+// cancelDiscoveryWatch stops the previous handler build's
+// discovery.Manager.Watch goroutines (and whatever DirProvider.Watch
+// spawned, e.g. an fsnotify.Watcher). NewHandler calls it before starting
+// a new watch so a reload doesn't leak the prior build's.
+var cancelDiscoveryWatch context.CancelFunc = func() {}
+
 func main() {
 	watcher, err := NewWatcher("./static", "./templates")
 	if err != nil {
@@ -35,83 +57,164 @@ func main() {
 	}
 	defer watcher.Close()
 
-	sigterm := make(chan os.Signal)
+	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, os.Interrupt, syscall.SIGINT)
 	signal.Notify(sigterm, os.Interrupt, syscall.SIGKILL)
 	signal.Notify(sigterm, os.Interrupt, syscall.SIGUSR1)
 	defer signal.Reset()
 
-	handler, err := NewHandler()
+	listener, err := listen("0.0.0.0:8080")
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer listener.Close()
 
-server:
-	for {
-		server := http.Server{
-			Handler: handler,
-			Addr:    "0.0.0.0:8080",
-		}
-
-		// setup event handler
-		action := make(chan string)
-		go func() {
-			act := ""
-			select {
-			case event, ok := <-watcher.Events:
-				log.Printf("Restarting server due to file changed: %s %s (ok:%t)", event.Op, event.Name, ok)
-				act = "reload"
-			case sig := <-sigterm:
-				log.Printf("Shutting down server due to %s", sig)
-				act = "shutdown"
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownDelayTolerance)
-			err := server.Shutdown(ctx)
-			log.Printf("Server shut down: %v", err)
-			action <- act
-			cancel()
-		}()
+	var handler atomicHandler
+	initial, err := NewHandler()
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler.Store(initial)
 
+	server := &http.Server{Handler: &handler}
+	go func() {
 		log.Println("Starting server...")
-		err = server.ListenAndServe()
-		if err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
+	}()
 
-		switch <-action {
-		case "reload":
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			log.Printf("Rebuilding handler due to file changed: %s %s (ok:%t)", event.Op, event.Name, ok)
 			watcher.Debounce(config.ReloadDebounceDelay)
 			newHandler, err := NewHandler()
 			if err != nil {
-				log.Printf("Failed to make a new server, restarting previous server. Error: %e", err)
-			} else {
-				handler = newHandler
+				log.Printf("Failed to build new handler, keeping previous one. Error: %v", err)
+				continue
 			}
-			continue server
-		case "shutdown":
-			break server
-		default:
-			break server
+			handler.Store(newHandler)
+			liveReload.Broadcast("reload")
+		case sig := <-sigterm:
+			log.Printf("Shutting down server due to %s", sig)
+			gracefulShutdown(server)
+			log.Println("Bye")
+			return
 		}
 	}
-	log.Println("Bye")
+}
+
+// atomicHandler lets the listener stay open across reload cycles while the
+// http.Handler backing it is swapped out: http.Server.Handler is read once
+// per request, so we hold it behind an atomic.Pointer and forward to
+// whatever was last Stored.
+type atomicHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func (a *atomicHandler) Store(h http.Handler) { a.h.Store(&h) }
+
+func (a *atomicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*a.h.Load()).ServeHTTP(w, r)
+}
+
+// gracefulShutdown drains in-flight requests for up to
+// config.ShutdownDrainDeadline; if that elapses first, it force-closes any
+// remaining connections, then waits up to config.ShutdownHardCap total for
+// Shutdown to return rather than blocking indefinitely.
+func gracefulShutdown(server *http.Server) {
+	done := make(chan error, 1)
+	go func() { done <- server.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-done:
+		log.Printf("Server shut down: %v", err)
+		return
+	case <-time.After(config.ShutdownDrainDeadline):
+		log.Printf("Drain deadline of %v exceeded, forcing remaining connections closed", config.ShutdownDrainDeadline)
+		server.Close()
+	}
+
+	select {
+	case err := <-done:
+		log.Printf("Server shut down: %v", err)
+	case <-time.After(config.ShutdownHardCap - config.ShutdownDrainDeadline):
+		log.Printf("Shutdown exceeded hard cap of %v, giving up waiting for it to return", config.ShutdownHardCap)
+	}
+}
+
+// listen returns a net.Listener for addr, preferring a socket inherited via
+// the systemd/LISTEN_FDS socket-activation protocol so a supervisor can
+// hand the listening socket off across binary restarts without any
+// downtime; falls back to a fresh net.Listen when nothing was inherited.
+func listen(addr string) (net.Listener, error) {
+	if l, ok, err := listenFromEnv(); err != nil {
+		return nil, err
+	} else if ok {
+		log.Println("Using socket-activated listener inherited from supervisor")
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenFromEnv implements the LISTEN_FDS/LISTEN_PID half of the
+// socket-activation protocol: file descriptor 3 (and up) is a listening
+// socket handed to us by the supervisor when LISTEN_PID matches our pid.
+func listenFromEnv() (net.Listener, bool, error) {
+	const listenFdsStart = 3
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, false, nil
+	}
+
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, false, err
+	}
+	return l, true, nil
 }
 
 func NewHandler() (http.Handler, error) {
-	db, err := cozo.New("sqlite", "todos.db", nil)
+	cdb, err := cozo.New("sqlite", "todos.db", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := CozoMigrate(cdb, Files, "migrations"); err != nil {
+		return nil, err
+	}
+
+	db, err := sqlx.Open("sqlite3", "todos.db")
 	if err != nil {
 		return nil, err
 	}
 
-	funcs := NewFuncs(db)
+	funcs := NewFuncs(db, cdb)
 
 	handler := http.NewServeMux()
 
-	// Serve files from static dir
+	// Serve files from static dir, fingerprinted so they can be cached
+	// immutably; the `asset` func lets templates rewrite a logical path to
+	// its hashed URL.
 	if staticFS, err := fs.Sub(Files, "static"); err == nil {
-		fileServer := http.FileServer(http.FS(staticFS))
-		// fileServer := statigz.FileServer(staticFS, brotli.AddEncoding)
-		handler.Handle("/static/", http.StripPrefix("/static/", fileServer))
+		assets, err := newAssetMap(staticFS)
+		if err != nil {
+			return nil, err
+		}
+		funcs["asset"] = assets.AssetFunc()
+		handler.Handle("/static/", http.StripPrefix("/static/", newHashedStaticServer(staticFS, assets)))
+	}
+
+	// Dev-only live reload: production (embedded) builds have nothing to
+	// watch, so don't expose the endpoint there.
+	if !AreFilesEmbedded {
+		handler.Handle("/_livereload", liveReload)
 	}
 
 	// find var Files in embed.go/embed0.go
@@ -131,6 +234,24 @@ func NewHandler() (http.Handler, error) {
 	}
 	// log.Printf("Found template files: shared: %+v; pages: %+v", sharedFiles, pageFiles)
 
+	// routes merges the template-backed routes found under templates/ with
+	// any additionally discovered from external sources (see
+	// package discovery), atomically swapping the mux as either changes.
+	routes := discovery.NewManager(func(g discovery.RouteGroup) (http.Handler, error) {
+		groupFuncs := funcs
+		if g.Funcs != nil {
+			groupFuncs = make(template.FuncMap, len(funcs)+len(g.Funcs))
+			for k, v := range funcs {
+				groupFuncs[k] = v
+			}
+			for k, v := range g.Funcs {
+				groupFuncs[k] = v
+			}
+		}
+		return TemplateHandler(g.FS, g.Templates, groupFuncs, cdb)
+	})
+
+	var localRoutes []discovery.RouteGroup
 	for _, pageFile := range pageFiles {
 		var path string
 		if filepath.Base(pageFile) == "index.html" {
@@ -140,13 +261,31 @@ func NewHandler() (http.Handler, error) {
 		}
 		route := strings.TrimSuffix(path, filepath.Ext(path))
 		files := append(append([]string(nil), sharedFiles...), pageFile)
-		pageHandler, err := TemplateHandler(templateFS, files, funcs)
-		if err != nil {
-			return nil, err
+		localRoutes = append(localRoutes, discovery.RouteGroup{Prefix: route, FS: templateFS, Templates: files})
+	}
+	if err := routes.Apply(localRoutes); err != nil {
+		return nil, err
+	}
+
+	// Optionally merge in routes discovered from outside templates/ (e.g.
+	// per-tenant template bundles dropped onto disk) without a restart.
+	// cancelDiscoveryWatch stops the watch started by the previous
+	// NewHandler call (if any) first, since that build's routes are about
+	// to be superseded by this one's.
+	cancelDiscoveryWatch()
+	cancelDiscoveryWatch = func() {}
+	if dir := os.Getenv("GOHTMX_ROUTES_DIR"); dir != "" {
+		if dirProvider, err := discovery.NewDirProvider(dir); err != nil {
+			log.Printf("discovery: %v", err)
+		} else {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelDiscoveryWatch = cancel
+			routes.Watch(ctx, dirProvider)
 		}
-		handler.Handle(route, pageHandler)
 	}
 
+	handler.Handle("/", routes)
+
 	return handler, nil
 }
 
@@ -169,26 +308,81 @@ func NewHandler() (http.Handler, error) {
 // - HTTP POST with nav param: post-nav
 // - HTTP DELETE with HX-Request header and id param: hx-delete-id
 // - HTTP POST with tYPe and iD params: post-id-type
-func TemplateHandler(fs fs.FS, files []string, funcs template.FuncMap) (http.HandlerFunc, error) {
+//
+// The page's init-<name> block may also call the `schema` template func
+// (building fields with `field`) to declare its expected query/form
+// params, e.g. {{schema (field "id" "uuid" true)}}. If it does, incoming
+// requests are coerced against that schema before the matched template
+// runs: validation failures render error-400 with a 400 status, and
+// successful ones are exposed to templates as the typed .Params map. The
+// schema's field names also narrow which query params GetRouteId
+// considers, so an unrelated tracking param doesn't change which nested
+// template matches.
+//
+// cdb backs the `cozotx` template func. html/template requires every
+// func a template references to be registered at Parse time, so
+// localFuncs gets a placeholder cozotx that just errors; TemplateHandler
+// rebinds the real one on a per-request template clone (see below)
+// rather than registering it in funcs directly, since its rollback
+// state (txBackup) must not be shared across concurrent requests.
+func TemplateHandler(fs fs.FS, files []string, funcs template.FuncMap, cdb cozo.CozoDB) (http.HandlerFunc, error) {
 	name := files[len(files)-1]
-	tmpl, err := template.New(name).Funcs(funcs).ParseFS(fs, files...)
+	pageName := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+
+	schemas := make(map[string]Schema)
+	var initializing string
+	localFuncs := make(template.FuncMap, len(funcs)+3)
+	for k, v := range funcs {
+		localFuncs[k] = v
+	}
+	localFuncs["field"] = NewField
+	localFuncs["schema"] = func(fields ...Field) Schema {
+		s := NewSchema(fields...)
+		schemas[initializing] = s
+		return s
+	}
+	localFuncs["cozotx"] = func(scripts ...string) ([]map[string]any, error) {
+		return nil, fmt.Errorf("cozotx: called outside of a request")
+	}
+
+	tmpl, err := template.New(name).Funcs(localFuncs).ParseFS(fs, files...)
 	if err != nil {
 		return nil, err
 	}
 	// log.Printf("Setting up handler for %v", files)
 	for _, file := range files {
-		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		initName := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
 
-		if t := tmpl.Lookup("init-" + name); t != nil {
-			// log.Printf("Initializing %s", name)
+		if t := tmpl.Lookup("init-" + initName); t != nil {
+			// log.Printf("Initializing %s", initName)
+			initializing = initName
 			err = t.Execute(io.Discard, nil)
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
+	schema := schemas[pageName]
+
+	// usesCozotx is computed once per handler build (not per request) by
+	// scanning this route's own template source for the literal "cozotx",
+	// so a page that never calls it skips the per-request Clone below.
+	usesCozotx := false
+	for _, file := range files {
+		f, ferr := fs.Open(file)
+		if ferr != nil {
+			continue
+		}
+		src, rerr := io.ReadAll(f)
+		f.Close()
+		if rerr == nil && strings.Contains(string(src), "cozotx") {
+			usesCozotx = true
+			break
+		}
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		routeId := GetRouteId(r)
+		routeId := GetRouteId(r, schema)
 
 		var err error
 		defer func(start time.Time) {
@@ -197,6 +391,20 @@ func TemplateHandler(fs fs.FS, files []string, funcs template.FuncMap) (http.Han
 
 		if t := tmpl.Lookup(routeId); t != nil {
 			r.ParseForm()
+
+			params, validationErrs := schema.Coerce(r.Form)
+			if len(validationErrs) > 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				errData := struct{ Errors []string }{validationErrs}
+				if errTmpl := tmpl.Lookup("error-400"); errTmpl != nil {
+					err = errTmpl.Execute(w, errData)
+				} else {
+					err = fmt.Errorf("validation failed: %v", validationErrs)
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+
 			data := struct {
 				Method   string
 				URL      *url.URL
@@ -204,6 +412,7 @@ func TemplateHandler(fs fs.FS, files []string, funcs template.FuncMap) (http.Han
 				Form     url.Values
 				PostForm url.Values
 				Body     io.ReadCloser
+				Params   map[string]any
 				// Future: User
 			}{
 				Method:   r.Method,
@@ -212,15 +421,71 @@ func TemplateHandler(fs fs.FS, files []string, funcs template.FuncMap) (http.Han
 				Form:     r.Form,
 				PostForm: r.PostForm,
 				Body:     r.Body,
+				Params:   params,
 			}
-			err = t.Execute(w, data)
+
+			execTmpl := tmpl
+			if usesCozotx {
+				// cozotx's rollback snapshots and restores the whole Cozo
+				// database (see backupCozo/cdb.Restore below), since the
+				// driver exposes no narrower undo. cozoTxMu serializes
+				// cozotx-using requests against each other so one
+				// request's restore can't revert another's in-flight
+				// cozotx writes; it does NOT protect against a concurrent
+				// request writing via the plain cozo/cozorun funcs, whose
+				// writes would still be reverted by a restore here.
+				cozoTxMu.Lock()
+				defer cozoTxMu.Unlock()
+
+				var txBackup string
+				reqTmpl, cloneErr := tmpl.Clone()
+				if cloneErr != nil {
+					err = cloneErr
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				reqTmpl = reqTmpl.Funcs(template.FuncMap{
+					"cozotx": func(scripts ...string) ([]map[string]any, error) {
+						if txBackup == "" {
+							if path, err := backupCozo(cdb); err != nil {
+								return nil, fmt.Errorf("cozotx: %w", err)
+							} else {
+								txBackup = path
+							}
+						}
+						return CozoTx(cdb, scripts)
+					},
+				})
+				execTmpl = reqTmpl
+
+				defer func() {
+					if txBackup == "" {
+						return
+					}
+					if err != nil {
+						if rerr := cdb.Restore(txBackup); rerr != nil {
+							log.Printf("cozotx: rollback after template execution error failed: %v", rerr)
+						} else {
+							log.Printf("cozotx: rolled back Cozo mutations after template execution error: %v", err)
+						}
+					}
+					os.Remove(txBackup)
+				}()
+			}
+
+			err = execTmpl.ExecuteTemplate(w, routeId, data)
 		} else {
 			http.NotFound(w, r)
 		}
 	}, nil
 }
 
-func GetRouteId(r *http.Request) string {
+// GetRouteId derives a routeId from r as described on TemplateHandler. If
+// schema declares any fields, only those field names are considered when
+// scanning URL query params (in addition to the existing "_"-prefix
+// filter), so a validated, declared param set disambiguates the route
+// rather than whatever raw query keys happen to be present.
+func GetRouteId(r *http.Request, schema Schema) string {
 	var prefix string
 	if r.Header.Get("HX-Request") == "true" {
 		prefix = "htmx"
@@ -228,15 +493,21 @@ func GetRouteId(r *http.Request) string {
 		prefix = "http"
 	}
 
+	allowed := schema.Names()
 	keys := maps.Keys(r.URL.Query())
 	sort.Strings(keys)
-	{ // filter out url parameters that start with _
+	{ // filter out url parameters that start with _, and any not declared
+		// by the schema (when one is declared)
 		i := 0
 		for j := 0; j < len(keys); j++ {
-			if !strings.HasPrefix(keys[j], "_") {
-				keys[i] = keys[j]
-				i++
+			if strings.HasPrefix(keys[j], "_") {
+				continue
+			}
+			if len(allowed) > 0 && !allowed[keys[j]] {
+				continue
 			}
+			keys[i] = keys[j]
+			i++
 		}
 		keys = keys[:i]
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Field describes one expected query/form parameter, as declared by a
+// page's init-<name> block via the field template func, e.g.
+// {{field "id" "uuid" true}} or {{field "status" "enum" false "open" "done"}}.
+type Field struct {
+	Name     string
+	Type     string // "string", "int", "bool", "uuid", "enum"
+	Required bool
+	Enum     []string
+}
+
+// NewField is the `field` template func.
+func NewField(name, typ string, required bool, enum ...string) Field {
+	return Field{Name: name, Type: typ, Required: required, Enum: enum}
+}
+
+// Schema is the set of Fields a page declares via its init-<name> block,
+// used to validate and coerce incoming request params and to let
+// GetRouteId ignore query params it wasn't told to expect.
+type Schema struct {
+	Fields []Field
+}
+
+// NewSchema is the `schema` template func, e.g.
+// {{schema (field "id" "uuid" true) (field "name" "string" false)}}.
+func NewSchema(fields ...Field) Schema {
+	return Schema{Fields: fields}
+}
+
+// Names returns the set of field names this schema declares.
+func (s Schema) Names() map[string]bool {
+	names := make(map[string]bool, len(s.Fields))
+	for _, f := range s.Fields {
+		names[f.Name] = true
+	}
+	return names
+}
+
+// Coerce validates values against the schema and converts each declared
+// field to its typed Go value. It collects every validation failure
+// rather than stopping at the first, so error-400 can report them all.
+func (s Schema) Coerce(values url.Values) (map[string]any, []string) {
+	params := make(map[string]any, len(s.Fields))
+	var errs []string
+
+	for _, f := range s.Fields {
+		raw := values.Get(f.Name)
+		if raw == "" {
+			if f.Required {
+				errs = append(errs, fmt.Sprintf("%s is required", f.Name))
+			}
+			continue
+		}
+
+		switch f.Type {
+		case "string":
+			params[f.Name] = raw
+		case "int":
+			v, err := strconv.Atoi(raw)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s must be an integer", f.Name))
+				continue
+			}
+			params[f.Name] = v
+		case "bool":
+			v, err := strconv.ParseBool(raw)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s must be a boolean", f.Name))
+				continue
+			}
+			params[f.Name] = v
+		case "uuid":
+			v, err := uuid.Parse(raw)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s must be a uuid", f.Name))
+				continue
+			}
+			params[f.Name] = v
+		case "enum":
+			if !stringsContain(f.Enum, raw) {
+				errs = append(errs, fmt.Sprintf("%s must be one of %v", f.Name, f.Enum))
+				continue
+			}
+			params[f.Name] = raw
+		default:
+			errs = append(errs, fmt.Sprintf("%s declares unknown schema type %q", f.Name, f.Type))
+		}
+	}
+
+	return params, errs
+}
+
+func stringsContain(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// asset is what newAssetMap records for one file under static/: its
+// content-hashed URL, and the hash itself (reused as the ETag, since
+// embed.FS reports a zero ModTime for every file and so can't back one).
+type asset struct {
+	url  string
+	hash string
+}
+
+// assetMap maps a logical static path ("/static/app.css") to its asset.
+// It's computed once per handler build by hashing each file under
+// static/: once at startup when AreFilesEmbedded, or on every
+// fsnotify-driven reload otherwise, since NewHandler (and therefore
+// newAssetMap) already runs again in that case.
+type assetMap map[string]asset
+
+// newAssetMap fingerprints every file in fsys with the first 8 hex
+// characters of its SHA-256, inserted before the file extension.
+func newAssetMap(fsys fs.FS) (assetMap, error) {
+	m := make(assetMap)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch path.Ext(p) {
+		case ".br", ".gz":
+			return nil // precompressed siblings aren't addressable assets themselves
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sum := hex.EncodeToString(h.Sum(nil))[:8]
+
+		ext := path.Ext(p)
+		hashedPath := strings.TrimSuffix(p, ext) + "." + sum + ext
+		m["/static/"+p] = asset{url: "/static/" + hashedPath, hash: sum}
+		return nil
+	})
+	return m, err
+}
+
+// AssetFunc returns the `asset` template func bound to m, rewriting a
+// logical static path to its content-hashed URL. An unrecognized path is
+// returned unchanged so it still 404s normally rather than panicking.
+func (m assetMap) AssetFunc() func(string) string {
+	return func(logical string) string {
+		if a, ok := m[logical]; ok {
+			return a.url
+		}
+		return logical
+	}
+}
+
+// realFile is what a hashed request path resolves back to: the real path
+// in fsys, and the content hash that produced the hashed URL.
+type realFile struct {
+	path string
+	hash string
+}
+
+// hashedStaticServer serves files under fsys at the content-hashed URLs
+// produced by assetMap, negotiating Accept-Encoding to prefer a
+// precompressed .br/.gz sibling over the file itself; if the client
+// accepts gzip and no .gz sibling exists, it compresses the plain file
+// on the fly rather than serving it uncompressed.
+type hashedStaticServer struct {
+	fsys fs.FS
+	// real maps a hashed request path back to its realFile; a path not in
+	// this map is served as-is (not cache-busted, no known hash).
+	real map[string]realFile
+}
+
+func newHashedStaticServer(fsys fs.FS, assets assetMap) *hashedStaticServer {
+	real := make(map[string]realFile, len(assets))
+	for logical, a := range assets {
+		real[strings.TrimPrefix(a.url, "/static/")] = realFile{
+			path: strings.TrimPrefix(logical, "/static/"),
+			hash: a.hash,
+		}
+	}
+	return &hashedStaticServer{fsys: fsys, real: real}
+}
+
+func (s *hashedStaticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqPath := strings.TrimPrefix(r.URL.Path, "/")
+	realPath, hash, hashed := reqPath, "", false
+	if a, ok := s.real[reqPath]; ok {
+		realPath, hash, hashed = a.path, a.hash, true
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	accept := r.Header.Get("Accept-Encoding")
+
+	if strings.Contains(accept, "br") && s.serveEncoded(w, r, realPath, hash, ".br", "br", hashed) {
+		return
+	}
+	if strings.Contains(accept, "gzip") && s.serveEncoded(w, r, realPath, hash, ".gz", "gzip", hashed) {
+		return
+	}
+
+	f, err := s.fsys.Open(realPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	setETag(w, hash)
+	setCacheControl(w, hashed)
+
+	if strings.Contains(accept, "gzip") {
+		// No precompressed .gz sibling: compress on the fly rather than
+		// serve uncompressed. The output size isn't known upfront, so this
+		// can't use http.ServeContent (it'd set a Content-Length for the
+		// uncompressed size); streaming means no Range support either.
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		io.Copy(gz, f)
+		return
+	}
+
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, realPath, stat.ModTime(), rs)
+		return
+	}
+	io.Copy(w, f)
+}
+
+// serveEncoded serves realPath+suffix (a precompressed sibling) if it
+// exists, reporting true so the caller doesn't fall through to another
+// encoding or the uncompressed file.
+func (s *hashedStaticServer) serveEncoded(w http.ResponseWriter, r *http.Request, realPath, hash, suffix, encoding string, hashed bool) bool {
+	f, err := s.fsys.Open(realPath + suffix)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	if hash != "" {
+		setETag(w, hash+"-"+encoding)
+	}
+	setCacheControl(w, hashed)
+
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, realPath, stat.ModTime(), rs)
+	} else {
+		io.Copy(w, f)
+	}
+	return true
+}
+
+func setCacheControl(w http.ResponseWriter, immutable bool) {
+	if immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+}
+
+// setETag sets the ETag header from hash when known; files outside
+// assetMap (hash == "") are left without one rather than fabricating a
+// value that carries no real information.
+func setETag(w http.ResponseWriter, hash string) {
+	if hash != "" {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+}